@@ -0,0 +1,157 @@
+package mesh
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultBroadcastCacheEntries is the default cap on the number of
+	// distinct broadcast-origin entries held in each of Routes' broadcast
+	// caches.
+	defaultBroadcastCacheEntries = 4096
+
+	// defaultBroadcastCacheTTL is how long a cached broadcast fan-out is
+	// trusted before it must be recalculated, bounding how long a node can
+	// go on forwarding broadcasts via a topology snapshot that may be
+	// stale.
+	defaultBroadcastCacheTTL = 10 * time.Minute
+)
+
+type broadcastCacheEntry struct {
+	name      PeerName
+	hops      []PeerName
+	expiresAt time.Time
+}
+
+// broadcastCache is a bounded, TTL-evicting LRU cache from broadcast-origin
+// PeerName to the fan-out of neighbours that should be notified. It exists
+// so that a node which sees broadcasts from many transient sources - peers
+// that have since been garbage collected - doesn't accumulate unbounded
+// cache entries referencing peers that no longer exist.
+type broadcastCache struct {
+	sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	ll         *list.List
+	items      map[PeerName]*list.Element
+}
+
+func newBroadcastCache(maxEntries int, ttl time.Duration) *broadcastCache {
+	return &broadcastCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		ll:         list.New(),
+		items:      make(map[PeerName]*list.Element),
+	}
+}
+
+// setLimits updates the cache's capacity and TTL, evicting immediately if
+// the new capacity is smaller than the current size.
+func (c *broadcastCache) setLimits(maxEntries int, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.maxEntries = maxEntries
+	c.ttl = ttl
+	c.evictOverCapacity()
+}
+
+func (c *broadcastCache) get(name PeerName) ([]PeerName, bool) {
+	c.Lock()
+	defer c.Unlock()
+	elem, found := c.items[name]
+	if !found {
+		return nil, false
+	}
+	entry := elem.Value.(*broadcastCacheEntry)
+	if c.ttl > 0 && time.Now().After(entry.expiresAt) {
+		c.removeElement(elem)
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+	return entry.hops, true
+}
+
+func (c *broadcastCache) add(name PeerName, hops []PeerName) {
+	c.Lock()
+	defer c.Unlock()
+	expiresAt := time.Time{}
+	if c.ttl > 0 {
+		expiresAt = time.Now().Add(c.ttl)
+	}
+	if elem, found := c.items[name]; found {
+		entry := elem.Value.(*broadcastCacheEntry)
+		entry.hops, entry.expiresAt = hops, expiresAt
+		c.ll.MoveToFront(elem)
+		return
+	}
+	elem := c.ll.PushFront(&broadcastCacheEntry{name: name, hops: hops, expiresAt: expiresAt})
+	c.items[name] = elem
+	c.evictOverCapacity()
+}
+
+// invalidate drops the cached entry for name, if any, so the next lookup
+// recomputes it from scratch. Callers should invoke this whenever a peer
+// is garbage collected, so its cached fan-out doesn't survive until the
+// next full recalculation.
+func (c *broadcastCache) invalidate(name PeerName) {
+	c.Lock()
+	defer c.Unlock()
+	if elem, found := c.items[name]; found {
+		c.removeElement(elem)
+	}
+}
+
+// reset clears the cache entirely, re-seeding it with a single entry. Used
+// at full recalculation, when every other cached fan-out may now be based
+// on stale topology.
+func (c *broadcastCache) reset(name PeerName, hops []PeerName) {
+	c.Lock()
+	defer c.Unlock()
+	c.ll.Init()
+	c.items = make(map[PeerName]*list.Element)
+	expiresAt := time.Time{}
+	if c.ttl > 0 {
+		expiresAt = time.Now().Add(c.ttl)
+	}
+	elem := c.ll.PushFront(&broadcastCacheEntry{name: name, hops: hops, expiresAt: expiresAt})
+	c.items[name] = elem
+}
+
+func (c *broadcastCache) evictOverCapacity() {
+	if c.maxEntries <= 0 {
+		return
+	}
+	for c.ll.Len() > c.maxEntries {
+		oldest := c.ll.Back()
+		if oldest == nil {
+			return
+		}
+		c.removeElement(oldest)
+	}
+}
+
+// snapshot returns a copy of the cache's current, non-expired entries. Used
+// to diff against a freshly computed fan-out when building a RouteDelta.
+func (c *broadcastCache) snapshot() map[PeerName][]PeerName {
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	res := make(map[PeerName][]PeerName, len(c.items))
+	for name, elem := range c.items {
+		entry := elem.Value.(*broadcastCacheEntry)
+		if c.ttl > 0 && now.After(entry.expiresAt) {
+			continue
+		}
+		res[name] = entry.hops
+	}
+	return res
+}
+
+// removeElement must be called with c locked.
+func (c *broadcastCache) removeElement(elem *list.Element) {
+	c.ll.Remove(elem)
+	entry := elem.Value.(*broadcastCacheEntry)
+	delete(c.items, entry.name)
+}
@@ -0,0 +1,133 @@
+package mesh
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBroadcastCacheAddAndGet(t *testing.T) {
+	c := newBroadcastCache(4, 0)
+	c.add(PeerName(1), []PeerName{PeerName(2), PeerName(3)})
+
+	hops, found := c.get(PeerName(1))
+	if !found {
+		t.Fatalf("expected entry for PeerName(1) to be found")
+	}
+	if len(hops) != 2 || hops[0] != PeerName(2) || hops[1] != PeerName(3) {
+		t.Fatalf("got hops %v, want [2 3]", hops)
+	}
+
+	if _, found := c.get(PeerName(99)); found {
+		t.Fatalf("expected no entry for an unknown name")
+	}
+}
+
+func TestBroadcastCacheEvictsOverCapacity(t *testing.T) {
+	c := newBroadcastCache(2, 0)
+	c.add(PeerName(1), []PeerName{PeerName(1)})
+	c.add(PeerName(2), []PeerName{PeerName(2)})
+	c.add(PeerName(3), []PeerName{PeerName(3)})
+
+	if _, found := c.get(PeerName(1)); found {
+		t.Fatalf("expected the least-recently-used entry (PeerName(1)) to have been evicted")
+	}
+	if _, found := c.get(PeerName(2)); !found {
+		t.Fatalf("expected PeerName(2) to still be cached")
+	}
+	if _, found := c.get(PeerName(3)); !found {
+		t.Fatalf("expected PeerName(3) to still be cached")
+	}
+}
+
+func TestBroadcastCacheGetRefreshesLRUOrder(t *testing.T) {
+	c := newBroadcastCache(2, 0)
+	c.add(PeerName(1), []PeerName{PeerName(1)})
+	c.add(PeerName(2), []PeerName{PeerName(2)})
+
+	// Touch PeerName(1) so it's now the most recently used.
+	if _, found := c.get(PeerName(1)); !found {
+		t.Fatalf("expected PeerName(1) to be cached before the touch")
+	}
+	c.add(PeerName(3), []PeerName{PeerName(3)})
+
+	if _, found := c.get(PeerName(2)); found {
+		t.Fatalf("expected PeerName(2) to have been evicted as the now-least-recently-used entry")
+	}
+	if _, found := c.get(PeerName(1)); !found {
+		t.Fatalf("expected PeerName(1) to survive eviction after being refreshed")
+	}
+}
+
+func TestBroadcastCacheTTLExpiry(t *testing.T) {
+	c := newBroadcastCache(4, time.Millisecond)
+	c.add(PeerName(1), []PeerName{PeerName(1)})
+
+	time.Sleep(5 * time.Millisecond)
+
+	if _, found := c.get(PeerName(1)); found {
+		t.Fatalf("expected entry to have expired after its TTL elapsed")
+	}
+}
+
+func TestBroadcastCacheInvalidate(t *testing.T) {
+	c := newBroadcastCache(4, 0)
+	c.add(PeerName(1), []PeerName{PeerName(1)})
+	c.invalidate(PeerName(1))
+
+	if _, found := c.get(PeerName(1)); found {
+		t.Fatalf("expected entry to be gone after invalidate")
+	}
+}
+
+func TestBroadcastCacheReset(t *testing.T) {
+	c := newBroadcastCache(4, 0)
+	c.add(PeerName(1), []PeerName{PeerName(1)})
+	c.add(PeerName(2), []PeerName{PeerName(2)})
+
+	c.reset(PeerName(3), []PeerName{PeerName(4)})
+
+	if _, found := c.get(PeerName(1)); found {
+		t.Fatalf("expected reset to clear pre-existing entries")
+	}
+	hops, found := c.get(PeerName(3))
+	if !found {
+		t.Fatalf("expected reset to seed the new entry for PeerName(3)")
+	}
+	if len(hops) != 1 || hops[0] != PeerName(4) {
+		t.Fatalf("got hops %v, want [4]", hops)
+	}
+}
+
+func TestBroadcastCacheSnapshotExcludesExpired(t *testing.T) {
+	c := newBroadcastCache(4, time.Millisecond)
+	c.add(PeerName(1), []PeerName{PeerName(1)})
+	time.Sleep(5 * time.Millisecond)
+	c.add(PeerName(2), []PeerName{PeerName(2)})
+
+	snap := c.snapshot()
+	if _, found := snap[PeerName(1)]; found {
+		t.Fatalf("expected expired entry to be excluded from the snapshot")
+	}
+	if _, found := snap[PeerName(2)]; !found {
+		t.Fatalf("expected fresh entry to be included in the snapshot")
+	}
+}
+
+func TestBroadcastCacheSetLimitsEvictsImmediately(t *testing.T) {
+	c := newBroadcastCache(4, 0)
+	c.add(PeerName(1), []PeerName{PeerName(1)})
+	c.add(PeerName(2), []PeerName{PeerName(2)})
+	c.add(PeerName(3), []PeerName{PeerName(3)})
+
+	c.setLimits(1, 0)
+
+	if _, found := c.get(PeerName(1)); found {
+		t.Fatalf("expected PeerName(1) to be evicted once capacity shrank to 1")
+	}
+	if _, found := c.get(PeerName(2)); found {
+		t.Fatalf("expected PeerName(2) to be evicted once capacity shrank to 1")
+	}
+	if _, found := c.get(PeerName(3)); !found {
+		t.Fatalf("expected the most recently added entry to survive")
+	}
+}
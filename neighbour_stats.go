@@ -0,0 +1,126 @@
+package mesh
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// statsDecayHalfLife is the time constant used to relax a neighbour's
+// tracked statistics back towards a neutral baseline when no fresh
+// measurements arrive, so a neighbour that was temporarily bad (e.g. during
+// a brief congestion episode) recovers rather than staying penalised
+// forever.
+const statsDecayHalfLife = 30 * time.Second
+
+// neighbourStat holds the running statistics we've observed for a single
+// neighbouring connection.
+type neighbourStat struct {
+	rtt         time.Duration // moving average round-trip time
+	delivery    float64       // moving average delivery success ratio, 0..1
+	throughput  float64       // moving average throughput, bytes/sec
+	lastUpdated time.Time
+}
+
+// NeighbourStats tracks per-neighbour connection quality - round-trip time,
+// delivery success ratio and recent throughput - as observed from
+// heartbeats and acks, so that gossip fan-out can be biased towards
+// neighbours that are actually serving us well.
+type NeighbourStats struct {
+	sync.Mutex
+	stats map[PeerName]*neighbourStat
+}
+
+// NewNeighbourStats returns an empty NeighbourStats ready to be updated and
+// queried.
+func NewNeighbourStats() *NeighbourStats {
+	return &NeighbourStats{stats: make(map[PeerName]*neighbourStat)}
+}
+
+const statsEWMAAlpha = 0.2
+
+func (nstats *NeighbourStats) get(name PeerName) *neighbourStat {
+	stat, found := nstats.stats[name]
+	if !found {
+		stat = &neighbourStat{delivery: 1, lastUpdated: time.Now()}
+		nstats.stats[name] = stat
+	}
+	return stat
+}
+
+// RecordHeartbeat updates the moving-average RTT for a neighbour, as
+// measured by a heartbeat/ack round trip.
+func (nstats *NeighbourStats) RecordHeartbeat(name PeerName, rtt time.Duration) {
+	nstats.Lock()
+	defer nstats.Unlock()
+	stat := nstats.get(name)
+	if stat.rtt == 0 {
+		stat.rtt = rtt
+	} else {
+		stat.rtt = time.Duration(statsEWMAAlpha*float64(rtt) + (1-statsEWMAAlpha)*float64(stat.rtt))
+	}
+	stat.lastUpdated = time.Now()
+}
+
+// RecordDelivery updates the moving-average delivery success ratio for a
+// neighbour, as measured by whether a heartbeat/ack was acknowledged.
+func (nstats *NeighbourStats) RecordDelivery(name PeerName, delivered bool) {
+	nstats.Lock()
+	defer nstats.Unlock()
+	stat := nstats.get(name)
+	sample := 0.0
+	if delivered {
+		sample = 1.0
+	}
+	stat.delivery = statsEWMAAlpha*sample + (1-statsEWMAAlpha)*stat.delivery
+	stat.lastUpdated = time.Now()
+}
+
+// RecordThroughput updates the moving-average throughput for a neighbour,
+// given that n bytes were delivered over duration d.
+func (nstats *NeighbourStats) RecordThroughput(name PeerName, n int, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	nstats.Lock()
+	defer nstats.Unlock()
+	stat := nstats.get(name)
+	sample := float64(n) / d.Seconds()
+	if stat.throughput == 0 {
+		stat.throughput = sample
+	} else {
+		stat.throughput = statsEWMAAlpha*sample + (1-statsEWMAAlpha)*stat.throughput
+	}
+	stat.lastUpdated = time.Now()
+}
+
+// Score returns a scalar quality score for name in (0, +inf), combining
+// observed RTT, delivery ratio and throughput. Higher is better. Neighbours
+// we have never measured score as a neutral 1.0, matching a neighbour whose
+// statistics have fully decayed.
+func (nstats *NeighbourStats) Score(name PeerName) float64 {
+	nstats.Lock()
+	defer nstats.Unlock()
+	stat, found := nstats.stats[name]
+	if !found {
+		return 1.0
+	}
+	decay := math.Exp2(-time.Since(stat.lastUpdated).Seconds() / statsDecayHalfLife.Seconds())
+
+	delivery := decay*stat.delivery + (1 - decay) // relax towards 1.0
+	rttScore := 1.0
+	if stat.rtt > 0 {
+		rttFactor := 1.0 / (1.0 + stat.rtt.Seconds())
+		rttScore = decay*rttFactor + (1 - decay)
+	}
+	throughputScore := 1.0
+	if stat.throughput > 0 {
+		throughputScore = decay*(1+stat.throughput/1e6) + (1 - decay)
+	}
+
+	score := delivery * rttScore * throughputScore
+	if score <= 0 {
+		score = 0.01
+	}
+	return score
+}
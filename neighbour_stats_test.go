@@ -0,0 +1,173 @@
+package mesh
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestNeighbourStatsScoreNeutralForUnmeasuredPeer(t *testing.T) {
+	nstats := NewNeighbourStats()
+	if got := nstats.Score(PeerName(1)); got != 1.0 {
+		t.Fatalf("Score for an unmeasured neighbour = %v, want 1.0", got)
+	}
+}
+
+func TestNeighbourStatsScoreReflectsFreshMeasurements(t *testing.T) {
+	nstats := NewNeighbourStats()
+	nstats.RecordDelivery(PeerName(1), false)
+	nstats.RecordDelivery(PeerName(1), false)
+	nstats.RecordDelivery(PeerName(1), false)
+
+	if got := nstats.Score(PeerName(1)); got >= 1.0 {
+		t.Fatalf("Score after repeated delivery failures = %v, want below the neutral 1.0", got)
+	}
+}
+
+// TestNeighbourStatsScoreDecaysTowardsNeutral verifies Score's time-based
+// decay without sleeping in the test: it forges lastUpdated into the past
+// by reaching directly into the package-private state.
+func TestNeighbourStatsScoreDecaysTowardsNeutral(t *testing.T) {
+	nstats := NewNeighbourStats()
+	nstats.RecordDelivery(PeerName(1), false)
+	nstats.RecordDelivery(PeerName(1), false)
+	nstats.RecordDelivery(PeerName(1), false)
+	fresh := nstats.Score(PeerName(1))
+
+	nstats.Lock()
+	nstats.stats[PeerName(1)].lastUpdated = time.Now().Add(-statsDecayHalfLife)
+	nstats.Unlock()
+	afterOneHalfLife := nstats.Score(PeerName(1))
+
+	if afterOneHalfLife <= fresh {
+		t.Fatalf("Score after one half-life = %v, want it to have relaxed upward from the fresh score %v", afterOneHalfLife, fresh)
+	}
+	if afterOneHalfLife >= 1.0 {
+		t.Fatalf("Score after only one half-life = %v, want it still below the fully-decayed neutral value of 1.0", afterOneHalfLife)
+	}
+
+	nstats.Lock()
+	nstats.stats[PeerName(1)].lastUpdated = time.Now().Add(-20 * statsDecayHalfLife)
+	nstats.Unlock()
+	fullyDecayed := nstats.Score(PeerName(1))
+	if math.Abs(fullyDecayed-1.0) > 1e-6 {
+		t.Fatalf("Score after many half-lives = %v, want it to have fully relaxed to the neutral 1.0", fullyDecayed)
+	}
+}
+
+func TestNeighbourStatsScoreRewardsLowerRTT(t *testing.T) {
+	nstats := NewNeighbourStats()
+	nstats.RecordHeartbeat(PeerName(1), 10*time.Millisecond)
+	nstats.RecordHeartbeat(PeerName(2), time.Second)
+
+	fast := nstats.Score(PeerName(1))
+	slow := nstats.Score(PeerName(2))
+	if fast <= slow {
+		t.Fatalf("expected the lower-RTT neighbour to score higher: fast=%v slow=%v", fast, slow)
+	}
+}
+
+func TestNeighbourStatsScoreRewardsHigherThroughput(t *testing.T) {
+	nstats := NewNeighbourStats()
+	nstats.RecordThroughput(PeerName(1), 10*1e6, time.Second) // ~10 MB/s
+	nstats.RecordThroughput(PeerName(2), 1*1024, time.Second) // ~1 KB/s
+
+	fast := nstats.Score(PeerName(1))
+	slow := nstats.Score(PeerName(2))
+	if fast <= slow {
+		t.Fatalf("expected the higher-throughput neighbour to score higher: fast=%v slow=%v", fast, slow)
+	}
+}
+
+func TestRandomNeighboursReturnsAllWhenFewerThanK(t *testing.T) {
+	routes := &Routes{
+		unicastAll:     unicastRoutes{PeerName(100): PeerName(2), PeerName(101): PeerName(2)},
+		stats:          NewNeighbourStats(),
+		neighbourScore: defaultNeighbourScore,
+	}
+	k := 5
+	routes.randomNeighboursK = &k
+
+	got := routes.RandomNeighbours(UnknownPeerName)
+	if len(got) != 1 || got[0] != PeerName(2) {
+		t.Fatalf("RandomNeighbours = %v, want the single bottleneck neighbour [2]", got)
+	}
+}
+
+func TestRandomNeighboursExcludesExceptAndUnknown(t *testing.T) {
+	routes := &Routes{
+		unicastAll: unicastRoutes{
+			PeerName(100): PeerName(2),
+			PeerName(101): PeerName(3),
+			PeerName(102): UnknownPeerName,
+		},
+		stats:          NewNeighbourStats(),
+		neighbourScore: defaultNeighbourScore,
+	}
+	k := 5
+	routes.randomNeighboursK = &k
+
+	got := routes.RandomNeighbours(PeerName(3))
+	if len(got) != 1 || got[0] != PeerName(2) {
+		t.Fatalf("RandomNeighbours(except=3) = %v, want [2] (3 excluded, UnknownPeerName never counted)", got)
+	}
+}
+
+func TestRandomNeighboursRespectsCountCap(t *testing.T) {
+	routes := &Routes{
+		unicastAll: unicastRoutes{
+			PeerName(100): PeerName(1),
+			PeerName(101): PeerName(2),
+			PeerName(102): PeerName(3),
+			PeerName(103): PeerName(4),
+		},
+		stats:          NewNeighbourStats(),
+		neighbourScore: defaultNeighbourScore,
+	}
+	k := 2
+	routes.randomNeighboursK = &k
+
+	got := routes.RandomNeighbours(UnknownPeerName)
+	if len(got) != 2 {
+		t.Fatalf("len(RandomNeighbours) = %d, want 2", len(got))
+	}
+	if got[0] == got[1] {
+		t.Fatalf("RandomNeighbours returned a duplicate: %v", got)
+	}
+}
+
+// TestRandomNeighboursWeightsTowardsHigherScore is a statistical test of the
+// Efraimidis-Spirakis weighted draw: given one candidate weighted far above
+// the rest, it should be picked in the overwhelming majority of trials. The
+// 90% threshold against a 100:1 weight ratio leaves ample margin to avoid
+// flakiness while still catching a scorer that's ignored or inverted.
+func TestRandomNeighboursWeightsTowardsHigherScore(t *testing.T) {
+	routes := &Routes{
+		unicastAll: unicastRoutes{
+			PeerName(100): PeerName(1), // the heavily-favoured candidate
+			PeerName(101): PeerName(2),
+			PeerName(102): PeerName(3),
+			PeerName(103): PeerName(4),
+		},
+		stats: NewNeighbourStats(),
+		neighbourScore: func(routes *Routes, name PeerName, bottleneckWeight int) float64 {
+			if name == PeerName(1) {
+				return 100
+			}
+			return 1
+		},
+	}
+	k := 1
+	routes.randomNeighboursK = &k
+
+	const trials = 500
+	favoured := 0
+	for i := 0; i < trials; i++ {
+		if got := routes.RandomNeighbours(UnknownPeerName); len(got) == 1 && got[0] == PeerName(1) {
+			favoured++
+		}
+	}
+	if favoured < trials*9/10 {
+		t.Fatalf("favoured candidate picked in %d/%d trials, want at least %d", favoured, trials, trials*9/10)
+	}
+}
@@ -0,0 +1,96 @@
+package mesh
+
+// RouteDelta describes what changed between two successive route
+// calculations, so that a subscriber such as the gossip layer can update
+// only the parts of its own state that are now stale - tearing down
+// GossipSenders for peers we lost reachability to, recomputing fan-out only
+// for the broadcast origins that actually changed - instead of re-querying
+// everything on every topology twitch.
+type RouteDelta struct {
+	// ReachableGained and ReachableLost list peers that became reachable
+	// or unreachable via unicast (established and symmetric connections)
+	// since the previous calculation.
+	ReachableGained []PeerName
+	ReachableLost   []PeerName
+
+	// UnicastChanged lists peers whose next hop changed in either the
+	// established-and-symmetric (Unicast) or the all-connections
+	// (UnicastAll) table, while the peer stayed reachable in that table.
+	UnicastChanged []PeerName
+
+	// BroadcastChanged lists broadcast-origin peers whose cached fan-out
+	// set changed. Only origins with a cached fan-out prior to this
+	// calculation are considered; origins nobody had asked about yet are
+	// left to be computed lazily on demand, as before.
+	BroadcastChanged []PeerName
+}
+
+// diffUnicast compares an old and new unicast routing table, returning the
+// peers that gained or lost reachability and the peers whose next hop
+// changed while remaining reachable throughout.
+func diffUnicast(old, updated unicastRoutes) (gained, lost, changed []PeerName) {
+	for name, newHop := range updated {
+		oldHop, found := old[name]
+		switch {
+		case !found:
+			gained = append(gained, name)
+		case oldHop != newHop:
+			changed = append(changed, name)
+		}
+	}
+	for name := range old {
+		if _, found := updated[name]; !found {
+			lost = append(lost, name)
+		}
+	}
+	return gained, lost, changed
+}
+
+// diffBroadcastCache recomputes the fan-out for every name that had a
+// cached entry prior to this calculation, returning those whose fan-out
+// changed. Must be called with routes.peers and routes.ourself read-locked.
+func (routes *Routes) diffBroadcastCache(old map[PeerName][]PeerName, establishedAndSymmetric bool) []PeerName {
+	var changed []PeerName
+	for name, oldHops := range old {
+		newHops := routes.calculateBroadcast(name, establishedAndSymmetric)
+		if !peerNameSliceEqual(oldHops, newHops) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+func peerNameSliceEqual(a, b []PeerName) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[PeerName]int, len(a))
+	for _, name := range a {
+		seen[name]++
+	}
+	for _, name := range b {
+		seen[name]--
+	}
+	for _, count := range seen {
+		if count != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func dedupPeerNames(names []PeerName) []PeerName {
+	if len(names) == 0 {
+		return names
+	}
+	seen := make(map[PeerName]struct{}, len(names))
+	res := make([]PeerName, 0, len(names))
+	for _, name := range names {
+		if _, found := seen[name]; found {
+			continue
+		}
+		seen[name] = struct{}{}
+		res = append(res, name)
+	}
+	return res
+}
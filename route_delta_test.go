@@ -0,0 +1,70 @@
+package mesh
+
+import "testing"
+
+func TestDiffUnicastGainedLostChanged(t *testing.T) {
+	old := unicastRoutes{
+		PeerName(1): PeerName(1),
+		PeerName(2): PeerName(2),
+		PeerName(3): PeerName(3),
+	}
+	updated := unicastRoutes{
+		PeerName(1): PeerName(1), // unchanged
+		PeerName(2): PeerName(9), // changed next hop
+		PeerName(4): PeerName(4), // gained
+	}
+
+	gained, lost, changed := diffUnicast(old, updated)
+
+	if len(gained) != 1 || gained[0] != PeerName(4) {
+		t.Fatalf("gained = %v, want [4]", gained)
+	}
+	if len(lost) != 1 || lost[0] != PeerName(3) {
+		t.Fatalf("lost = %v, want [3]", lost)
+	}
+	if len(changed) != 1 || changed[0] != PeerName(2) {
+		t.Fatalf("changed = %v, want [2]", changed)
+	}
+}
+
+func TestDiffUnicastNoChanges(t *testing.T) {
+	old := unicastRoutes{PeerName(1): PeerName(1)}
+	updated := unicastRoutes{PeerName(1): PeerName(1)}
+
+	gained, lost, changed := diffUnicast(old, updated)
+	if len(gained) != 0 || len(lost) != 0 || len(changed) != 0 {
+		t.Fatalf("expected no deltas, got gained=%v lost=%v changed=%v", gained, lost, changed)
+	}
+}
+
+func TestPeerNameSliceEqual(t *testing.T) {
+	cases := []struct {
+		a, b []PeerName
+		want bool
+	}{
+		{nil, nil, true},
+		{[]PeerName{}, nil, true},
+		{[]PeerName{1, 2}, []PeerName{2, 1}, true},
+		{[]PeerName{1, 2}, []PeerName{1, 2, 3}, false},
+		{[]PeerName{1, 2}, []PeerName{1, 3}, false},
+		{[]PeerName{1, 1, 2}, []PeerName{1, 2, 2}, false},
+	}
+	for _, c := range cases {
+		if got := peerNameSliceEqual(c.a, c.b); got != c.want {
+			t.Errorf("peerNameSliceEqual(%v, %v) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestDedupPeerNames(t *testing.T) {
+	got := dedupPeerNames([]PeerName{1, 2, 1, 3, 2})
+	want := []PeerName{1, 2, 3}
+	if len(got) != len(want) {
+		t.Fatalf("dedupPeerNames = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("dedupPeerNames = %v, want %v", got, want)
+		}
+	}
+}
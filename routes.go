@@ -2,25 +2,40 @@ package mesh
 
 import (
 	"math"
+	"math/rand"
+	"sort"
 	"sync"
+	"time"
 )
 
 type unicastRoutes map[PeerName]PeerName
-type broadcastRoutes map[PeerName][]PeerName
+type unicastPathRoutes map[PeerName][]PeerName
+
+// defaultMaxUnicastPaths is the default cap on the number of equal (or
+// near-equal) cost next-hops UnicastPaths will return for a destination.
+const defaultMaxUnicastPaths = 4
 
 // Routes aggregates unicast and broadcast routes for our peer.
 type Routes struct {
 	sync.RWMutex
-	ourself      *LocalPeer
-	peers        *Peers
-	onChange     []func()
-	unicast      unicastRoutes
-	unicastAll   unicastRoutes // [1]
-	broadcast    broadcastRoutes
-	broadcastAll broadcastRoutes // [1]
-	recalculate  chan<- *struct{}
-	wait         chan<- chan struct{}
-	action       chan<- func()
+	ourself           *LocalPeer
+	peers             *Peers
+	onChange          []func()
+	onChangeDetailed  []func(RouteDelta)
+	unicast           unicastRoutes
+	unicastAll        unicastRoutes // [1]
+	broadcast         *broadcastCache
+	broadcastAll      *broadcastCache // [1]
+	unicastPaths      unicastPathRoutes
+	maxUnicastPaths   int
+	unicastPathSlack  uint // additive hop-count slack admitted as "near-equal" cost; 0 means strictly equal
+	tree              *treeState
+	stats             *NeighbourStats
+	neighbourScore    func(routes *Routes, name PeerName, bottleneckWeight int) float64
+	randomNeighboursK *int // overrides the default log2(n_peers) if non-nil
+	recalculate       chan<- *struct{}
+	wait              chan<- chan struct{}
+	action            chan<- func()
 	// [1] based on *all* connections, not just established &
 	// symmetric ones
 }
@@ -31,16 +46,22 @@ func NewRoutes(ourself *LocalPeer, peers *Peers) *Routes {
 	wait := make(chan chan struct{})
 	action := make(chan func())
 	routes := &Routes{
-		ourself:      ourself,
-		peers:        peers,
-		unicast:      unicastRoutes{ourself.Name: UnknownPeerName},
-		unicastAll:   unicastRoutes{ourself.Name: UnknownPeerName},
-		broadcast:    broadcastRoutes{ourself.Name: []PeerName{}},
-		broadcastAll: broadcastRoutes{ourself.Name: []PeerName{}},
-		recalculate:  recalculate,
-		wait:         wait,
-		action:       action,
+		ourself:         ourself,
+		peers:           peers,
+		unicast:         unicastRoutes{ourself.Name: UnknownPeerName},
+		unicastAll:      unicastRoutes{ourself.Name: UnknownPeerName},
+		broadcast:       newBroadcastCache(defaultBroadcastCacheEntries, defaultBroadcastCacheTTL),
+		broadcastAll:    newBroadcastCache(defaultBroadcastCacheEntries, defaultBroadcastCacheTTL),
+		unicastPaths:    unicastPathRoutes{ourself.Name: []PeerName{}},
+		maxUnicastPaths: defaultMaxUnicastPaths,
+		tree:            newTreeState(ourself.Name),
+		stats:           NewNeighbourStats(),
+		neighbourScore:  defaultNeighbourScore,
+		recalculate:     recalculate,
+		wait:            wait,
+		action:          action,
 	}
+	peers.OnGC(func(peer *Peer) { routes.InvalidateBroadcast(peer.Name) })
 	go routes.run(recalculate, wait, action)
 	return routes
 }
@@ -53,6 +74,16 @@ func (routes *Routes) OnChange(callback func()) {
 	routes.onChange = append(routes.onChange, callback)
 }
 
+// OnChangeDetailed appends callback to the functions that will be called
+// with a RouteDelta whenever the routes are recalculated, describing what
+// changed since the previous calculation. Use this instead of OnChange when
+// re-querying every route on each change would be wasteful.
+func (routes *Routes) OnChangeDetailed(callback func(RouteDelta)) {
+	routes.Lock()
+	defer routes.Unlock()
+	routes.onChangeDetailed = append(routes.onChangeDetailed, callback)
+}
+
 // PeerNames returns the peers that are accountd for in the routes.
 func (routes *Routes) PeerNames() PeerNameSet {
 	return routes.peers.Names()
@@ -76,78 +107,201 @@ func (routes *Routes) UnicastAll(name PeerName) (PeerName, bool) {
 	return hop, found
 }
 
+// UnicastPaths returns up to the configured maximum number of equal (or,
+// if a slack is configured via SetUnicastPathSlack, near-equal) cost next
+// hops on the unicast route to the named peer, based on established and
+// symmetric connections. Callers that need to forward a flow of packets can
+// hash a flow key into this slice to spread load over parallel paths while
+// keeping any one flow on a stable path, and fall back to one of the
+// remaining hops if the chosen one's connection goes away.
+func (routes *Routes) UnicastPaths(name PeerName) []PeerName {
+	routes.RLock()
+	defer routes.RUnlock()
+	hops := routes.unicastPaths[name]
+	res := make([]PeerName, len(hops))
+	copy(res, hops)
+	return res
+}
+
+// SetMaxUnicastPaths caps the number of next-hops UnicastPaths returns for
+// a single destination. A non-positive n disables the cap.
+func (routes *Routes) SetMaxUnicastPaths(n int) {
+	routes.Lock()
+	defer routes.Unlock()
+	routes.maxUnicastPaths = n
+}
+
+// SetUnicastPathSlack controls how much longer than the shortest path an
+// alternate path may be while still being admitted by UnicastPaths as a
+// backup next-hop. A slack of 0 (the default) means only strictly-equal-cost
+// paths are admitted; sparse mesh topologies often benefit from a small
+// positive slack, since they otherwise rarely have any equal-cost
+// alternates at all.
+func (routes *Routes) SetUnicastPathSlack(slack uint) {
+	routes.Lock()
+	defer routes.Unlock()
+	routes.unicastPathSlack = slack
+}
+
 // Broadcast returns the set of peer names that should be notified
 // when we receive a broadcast message originating from the named peer
 // based on established and symmetric connections.
 func (routes *Routes) Broadcast(name PeerName) []PeerName {
-	return routes.lookupOrCalculate(name, &routes.broadcast, true)
+	return routes.lookupOrCalculate(name, routes.broadcast, true)
 }
 
 // BroadcastAll returns the set of peer names that should be notified
 // when we receive a broadcast message originating from the named peer
 // based on all connections.
 func (routes *Routes) BroadcastAll(name PeerName) []PeerName {
-	return routes.lookupOrCalculate(name, &routes.broadcastAll, false)
+	return routes.lookupOrCalculate(name, routes.broadcastAll, false)
 }
 
-func (routes *Routes) lookupOrCalculate(name PeerName, broadcast *broadcastRoutes, establishedAndSymmetric bool) []PeerName {
-	routes.RLock()
-	hops, found := (*broadcast)[name]
-	routes.RUnlock()
-	if found {
+// InvalidateBroadcast drops any cached broadcast fan-out for name from both
+// the established-and-symmetric and all-connections caches, so a stale
+// fan-out referencing a peer that no longer exists doesn't survive until
+// the next full recalculation. NewRoutes wires this up to Peers' OnGC, so
+// callers don't normally need to call this directly; it remains exported
+// for tests and for callers managing their own Peers lifecycle.
+func (routes *Routes) InvalidateBroadcast(name PeerName) {
+	routes.broadcast.invalidate(name)
+	routes.broadcastAll.invalidate(name)
+}
+
+// SetBroadcastCacheLimits configures the capacity and per-entry TTL of the
+// broadcast fan-out caches. A non-positive maxEntries disables the
+// capacity bound, and a non-positive ttl disables expiry.
+func (routes *Routes) SetBroadcastCacheLimits(maxEntries int, ttl time.Duration) {
+	routes.broadcast.setLimits(maxEntries, ttl)
+	routes.broadcastAll.setLimits(maxEntries, ttl)
+}
+
+func (routes *Routes) lookupOrCalculate(name PeerName, cache *broadcastCache, establishedAndSymmetric bool) []PeerName {
+	if hops, found := cache.get(name); found {
 		return hops
 	}
 	res := make(chan []PeerName)
 	routes.action <- func() {
-		routes.RLock()
-		hops, found := (*broadcast)[name]
-		routes.RUnlock()
-		if found {
+		if hops, found := cache.get(name); found {
 			res <- hops
 			return
 		}
 		routes.peers.RLock()
 		routes.ourself.RLock()
-		hops = routes.calculateBroadcast(name, establishedAndSymmetric)
+		hops := routes.calculateBroadcast(name, establishedAndSymmetric)
 		routes.ourself.RUnlock()
 		routes.peers.RUnlock()
 		res <- hops
-		routes.Lock()
-		(*broadcast)[name] = hops
-		routes.Unlock()
+		cache.add(name, hops)
 	}
 	return <-res
 }
 
-// RandomNeighbours chooses min(log2(n_peers), n_neighbouring_peers)
-// neighbours, with a random distribution that is topology-sensitive,
-// favouring neighbours at the end of "bottleneck links". We determine the
-// latter based on the unicast routing table. If a neighbour appears as the
-// value more frequently than others - meaning that we reach a higher
-// proportion of peers via that neighbour than other neighbours - then it is
-// chosen with a higher probability.
+// defaultNeighbourScore combines the bottleneck weight (how many peers we
+// reach via this neighbour) with its measured connection quality into a
+// single scalar weight for Efraimidis-Spirakis sampling. Both factors are
+// weighted multiplicatively so that a neighbour which is both a bottleneck
+// and reliable dominates, but a bottleneck neighbour with poor measured
+// quality doesn't automatically win.
+func defaultNeighbourScore(routes *Routes, name PeerName, bottleneckWeight int) float64 {
+	return float64(bottleneckWeight) * routes.stats.Score(name)
+}
+
+// SetNeighbourScorer overrides the function used to turn a neighbour's
+// bottleneck weight and observed statistics into a sampling weight for
+// RandomNeighbours. Passing nil restores the default.
+func (routes *Routes) SetNeighbourScorer(score func(routes *Routes, name PeerName, bottleneckWeight int) float64) {
+	routes.Lock()
+	defer routes.Unlock()
+	if score == nil {
+		score = defaultNeighbourScore
+	}
+	routes.neighbourScore = score
+}
+
+// SetRandomNeighboursK overrides the number of neighbours RandomNeighbours
+// returns, in place of the default log2(n_peers). Passing a non-positive k
+// reverts to the default.
+func (routes *Routes) SetRandomNeighboursK(k int) {
+	routes.Lock()
+	defer routes.Unlock()
+	if k <= 0 {
+		routes.randomNeighboursK = nil
+		return
+	}
+	routes.randomNeighboursK = &k
+}
+
+// Stats returns the NeighbourStats tracking this Routes' per-neighbour
+// connection quality, so callers can feed it observed RTT, delivery and
+// throughput measurements.
+func (routes *Routes) Stats() *NeighbourStats {
+	return routes.stats
+}
+
+// RandomNeighbours chooses min(k, n_neighbouring_peers) neighbours, where k
+// defaults to log2(n_peers) but can be overridden via
+// SetRandomNeighboursK. Selection is a weighted random draw without
+// replacement (Efraimidis-Spirakis), so that neighbours are chosen with
+// probability proportional to their weight while still exploring the full
+// set over time, rather than the same bottleneck neighbours being picked on
+// every call.
+//
+// The weight for each candidate combines the bottleneck weight (how many
+// peers we reach via that neighbour, per the unicast routing table) with
+// its measured connection quality (RTT, delivery ratio, throughput; see
+// NeighbourStats), via the function registered with SetNeighbourScorer.
 //
-// Note that we choose log2(n_peers) *neighbours*, not peers. Consequently, on
-// sparsely connected peers this function returns a higher proportion of
-// neighbours than elsewhere. In extremis, on peers with fewer than
-// log2(n_peers) neighbours, all neighbours are returned.
+// Note that we choose k *neighbours*, not peers. Consequently, on sparsely
+// connected peers this function returns a higher proportion of neighbours
+// than elsewhere. In extremis, on peers with fewer than k neighbours, all
+// neighbours are returned.
 func (routes *Routes) RandomNeighbours(except PeerName) []PeerName {
-	destinations := make(PeerNameSet)
 	routes.RLock()
 	defer routes.RUnlock()
-	count := int(math.Log2(float64(len(routes.unicastAll))))
-	// depends on go's random map iteration
+
+	bottleneck := make(map[PeerName]int)
 	for _, dst := range routes.unicastAll {
 		if dst != UnknownPeerName && dst != except {
-			destinations[dst] = struct{}{}
-			if len(destinations) >= count {
-				break
-			}
+			bottleneck[dst]++
+		}
+	}
+
+	count := int(math.Log2(float64(len(routes.unicastAll))))
+	if routes.randomNeighboursK != nil {
+		count = *routes.randomNeighboursK
+	}
+	if count >= len(bottleneck) {
+		res := make([]PeerName, 0, len(bottleneck))
+		for dst := range bottleneck {
+			res = append(res, dst)
+		}
+		return res
+	}
+
+	type candidate struct {
+		name PeerName
+		key  float64
+	}
+	candidates := make([]candidate, 0, len(bottleneck))
+	for dst, weight := range bottleneck {
+		w := routes.neighbourScore(routes, dst, weight)
+		if w <= 0 {
+			w = 1e-9
+		}
+		u := rand.Float64()
+		if u <= 0 {
+			u = 1e-9
 		}
+		candidates = append(candidates, candidate{dst, math.Pow(u, 1/w)})
 	}
-	res := make([]PeerName, 0, len(destinations))
-	for dst := range destinations {
-		res = append(res, dst)
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].key > candidates[j].key })
+	if count > len(candidates) {
+		count = len(candidates)
+	}
+	res := make([]PeerName, count)
+	for i := 0; i < count; i++ {
+		res[i] = candidates[i].name
 	}
 	return res
 }
@@ -173,6 +327,8 @@ func (routes *Routes) EnsureRecalculated() {
 }
 
 func (routes *Routes) run(recalculate <-chan *struct{}, wait <-chan chan struct{}, action <-chan func()) {
+	treeTicker := time.NewTicker(treeAnnounceInterval)
+	defer treeTicker.Stop()
 	for {
 		select {
 		case <-recalculate:
@@ -186,35 +342,63 @@ func (routes *Routes) run(recalculate <-chan *struct{}, wait <-chan chan struct{
 			close(done)
 		case f := <-action:
 			f()
+		case <-treeTicker.C:
+			routes.treeTick()
 		}
 	}
 }
 
 func (routes *Routes) calculate() {
+	routes.RLock()
+	oldUnicast, oldUnicastAll := routes.unicast, routes.unicastAll
+	maxUnicastPaths, unicastPathSlack := routes.maxUnicastPaths, routes.unicastPathSlack
+	routes.RUnlock()
+	oldBroadcast := routes.broadcast.snapshot()
+	oldBroadcastAll := routes.broadcastAll.snapshot()
+
 	routes.peers.RLock()
 	routes.ourself.RLock()
 	var (
-		unicast      = routes.calculateUnicast(true)
-		unicastAll   = routes.calculateUnicast(false)
-		broadcast    = make(broadcastRoutes)
-		broadcastAll = make(broadcastRoutes)
+		unicast         = routes.calculateUnicast(true)
+		unicastAll      = routes.calculateUnicast(false)
+		ourBroadcast    = routes.calculateBroadcast(routes.ourself.Name, true)
+		ourBroadcastAll = routes.calculateBroadcast(routes.ourself.Name, false)
+		unicastPaths    = routes.calculateUnicastPaths(true, maxUnicastPaths, unicastPathSlack)
 	)
-	broadcast[routes.ourself.Name] = routes.calculateBroadcast(routes.ourself.Name, true)
-	broadcastAll[routes.ourself.Name] = routes.calculateBroadcast(routes.ourself.Name, false)
+	gained, lost, changed := diffUnicast(oldUnicast, unicast)
+	_, _, changedAll := diffUnicast(oldUnicastAll, unicastAll)
+	broadcastChanged := routes.diffBroadcastCache(oldBroadcast, true)
+	broadcastChanged = append(broadcastChanged, routes.diffBroadcastCache(oldBroadcastAll, false)...)
+	delta := RouteDelta{
+		ReachableGained:  gained,
+		ReachableLost:    lost,
+		UnicastChanged:   dedupPeerNames(append(changed, changedAll...)),
+		BroadcastChanged: dedupPeerNames(broadcastChanged),
+	}
 	routes.ourself.RUnlock()
 	routes.peers.RUnlock()
 
+	// The topology has moved on, so every other cached broadcast fan-out
+	// may now be stale; drop them and reseed with our own fan-out, which we
+	// always want available without a further round-trip through the
+	// action channel.
+	routes.broadcast.reset(routes.ourself.Name, ourBroadcast)
+	routes.broadcastAll.reset(routes.ourself.Name, ourBroadcastAll)
+
 	routes.Lock()
 	routes.unicast = unicast
 	routes.unicastAll = unicastAll
-	routes.broadcast = broadcast
-	routes.broadcastAll = broadcastAll
+	routes.unicastPaths = unicastPaths
 	onChange := routes.onChange
+	onChangeDetailed := routes.onChangeDetailed
 	routes.Unlock()
 
 	for _, callback := range onChange {
 		callback()
 	}
+	for _, callback := range onChangeDetailed {
+		callback(delta)
+	}
 }
 
 // Calculate all the routes for the question: if *we* want to send a
@@ -231,6 +415,14 @@ func (routes *Routes) calculateUnicast(establishedAndSymmetric bool) unicastRout
 	return unicast
 }
 
+// calculateUnicastPaths computes, for each known peer, every next-hop that
+// lies on a shortest (or, within the given slack, near-shortest) path from
+// ourself to that peer, capped at maxPaths. See calculateAllShortestPaths
+// for how this is derived from the single-path Peer.Routes primitive.
+func (routes *Routes) calculateUnicastPaths(establishedAndSymmetric bool, maxPaths int, slack uint) unicastPathRoutes {
+	return routes.calculateAllShortestPaths(establishedAndSymmetric, maxPaths, slack)
+}
+
 // Calculate the route to answer the question: if we receive a
 // broadcast originally from Peer X, which peers should we pass the
 // frames on to?
@@ -0,0 +1,294 @@
+package mesh
+
+import "time"
+
+const (
+	// treeAnnounceInterval is how often a peer re-issues its spanning-tree
+	// root announcement via gossip.
+	treeAnnounceInterval = 30 * time.Second
+
+	// treeRootTimeout is how long a peer will wait without hearing a
+	// fresher announcement for the current root before assuming the root
+	// has gone and promoting itself.
+	treeRootTimeout = time.Minute
+
+	// treeHysteresis is the margin by which a candidate parent's distance
+	// to the root must beat our current parent's before we switch,
+	// avoiding coordinate churn when two paths are almost equal.
+	treeHysteresis = 2
+)
+
+// RootAnnouncement describes a claim to be (or to have a path to) the
+// spanning-tree root. Peers gossip these to converge on a single root: the
+// peer with the lowest name wins, and a stale claim from the incumbent root
+// is beaten by a fresher one carrying a higher sequence number.
+type RootAnnouncement struct {
+	Root     PeerName
+	Seq      uint64
+	Distance uint64
+}
+
+// supersedes reports whether ann should replace other as the best known
+// claim about the tree root.
+func (ann RootAnnouncement) supersedes(other RootAnnouncement) bool {
+	switch {
+	case ann.Root != other.Root:
+		return ann.Root < other.Root
+	case ann.Seq != other.Seq:
+		return ann.Seq > other.Seq
+	default:
+		return ann.Distance < other.Distance
+	}
+}
+
+// treeNeighbour records the most recent root announcement and coordinate
+// advertised to us by one of our neighbours.
+type treeNeighbour struct {
+	RootAnnouncement
+	Coord []uint64
+}
+
+// treeState holds everything Routes needs to compute and forward by
+// spanning-tree coordinates. It lives inside Routes and is protected by the
+// same RWMutex.
+type treeState struct {
+	self       RootAnnouncement // our own best-known claim about the root
+	coord      []uint64         // our coordinate: parent's coordinate + the port we use to reach it
+	parent     PeerName
+	haveParent bool
+	lastSeen   time.Time // last time we heard a fresher claim from the current root (or became root ourselves)
+
+	// selfSeq is the Seq namespace for claims where we are the root,
+	// advanced by promoteSelf and raised by recompute when a neighbour
+	// echoes a fresher claim of ours. Keeping it separate from self.Seq
+	// means a foreign root's claim - which self.Seq also holds whenever
+	// we've adopted one - can never leak into, or roll back, the sequence
+	// number of our own candidacy.
+	selfSeq uint64
+
+	neighbours map[PeerName]treeNeighbour
+	ports      map[PeerName]uint64 // lazily assigned per-neighbour link ids, stable for the session
+	nextPort   uint64
+
+	announce func(RootAnnouncement, []uint64) // registered by the gossip layer; nil until OnTreeAnnouncement is called
+}
+
+func newTreeState(ourself PeerName) *treeState {
+	return &treeState{
+		self:       RootAnnouncement{Root: ourself, Seq: 0, Distance: 0},
+		coord:      []uint64{},
+		neighbours: make(map[PeerName]treeNeighbour),
+		ports:      make(map[PeerName]uint64),
+		lastSeen:   time.Now(),
+	}
+}
+
+// OnTreeAnnouncement registers callback to be invoked with our current root
+// announcement and coordinate once every treeAnnounceInterval. A change to
+// either is not announced on its own; it goes out with the next periodic
+// re-issue. The gossip layer is expected to piggyback this on its normal
+// traffic.
+func (routes *Routes) OnTreeAnnouncement(callback func(RootAnnouncement, []uint64)) {
+	routes.Lock()
+	defer routes.Unlock()
+	routes.tree.announce = callback
+}
+
+// TreeCoords returns our current spanning-tree coordinate: a sequence of
+// port/link ids from the root down to us. The root's coordinate is the
+// empty slice.
+func (routes *Routes) TreeCoords() []uint64 {
+	routes.RLock()
+	defer routes.RUnlock()
+	coord := make([]uint64, len(routes.tree.coord))
+	copy(coord, routes.tree.coord)
+	return coord
+}
+
+// TreeNextHop returns the neighbour to forward a packet towards in order to
+// make progress towards the tree coordinate dst, based on the longest
+// common coordinate prefix. It falls back to false if no neighbour's
+// coordinate shares a longer prefix with dst than our own does, leaving the
+// caller to fall back to the shortest-path unicast table.
+func (routes *Routes) TreeNextHop(dst []uint64) (PeerName, bool) {
+	routes.RLock()
+	defer routes.RUnlock()
+	own := treeCommonPrefixLen(routes.tree.coord, dst)
+	best := own
+	var (
+		bestHop  PeerName
+		bestDist uint64
+		found    bool
+	)
+	for name, n := range routes.tree.neighbours {
+		prefix := treeCommonPrefixLen(n.Coord, dst)
+		if prefix <= own || prefix < best {
+			continue
+		}
+		if prefix == best && found && n.Distance >= bestDist {
+			continue
+		}
+		best, bestHop, bestDist, found = prefix, name, n.Distance, true
+	}
+	return bestHop, found
+}
+
+func treeCommonPrefixLen(a, b []uint64) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	i := 0
+	for i < n && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// HandleRootAnnouncement processes a root announcement and coordinate
+// gossiped to us by one of our neighbours, updating our own claim and
+// coordinate if it changes as a result.
+func (routes *Routes) HandleRootAnnouncement(from PeerName, ann RootAnnouncement, coord []uint64) {
+	routes.Lock()
+	defer routes.Unlock()
+	routes.tree.neighbours[from] = treeNeighbour{RootAnnouncement: ann, Coord: coord}
+	routes.recomputeTree()
+}
+
+// InvalidateTreeNeighbour drops any cached announcement from a neighbour
+// that is no longer connected, so it can't keep influencing our root or
+// parent choice.
+func (routes *Routes) InvalidateTreeNeighbour(name PeerName) {
+	routes.Lock()
+	defer routes.Unlock()
+	delete(routes.tree.neighbours, name)
+	delete(routes.tree.ports, name)
+	routes.recomputeTree()
+}
+
+// recomputeTree picks the best root and parent out of our neighbours'
+// announcements (and our own candidacy), and derives our coordinate from
+// the result. Must be called with routes.Lock held.
+func (routes *Routes) recomputeTree() {
+	routes.tree.recompute(routes.ourself.Name)
+}
+
+// recompute is the pure decision logic behind recomputeTree, taking
+// ourself's name as a plain argument so it can be exercised directly in
+// tests without needing a full Routes/LocalPeer/Peers setup.
+func (ts *treeState) recompute(ourself PeerName) {
+	// Our own candidacy is always "we are the root", regardless of what
+	// root we'd previously adopted from a neighbour - ts.self may
+	// currently hold a foreign root's claim, which must never be replayed
+	// as if it were ours. Its Seq comes from ts.selfSeq, our own namespace
+	// that only our own claims ever advance, rather than ts.self.Seq, which
+	// a foreign claim may have overwritten.
+	self := RootAnnouncement{Root: ourself, Seq: ts.selfSeq, Distance: 0}
+	best := self
+	for _, n := range ts.neighbours {
+		candidate := n.RootAnnouncement
+		candidate.Distance = n.Distance + 1
+		if candidate.supersedes(best) {
+			best = candidate
+		}
+	}
+
+	if best.Root == ourself {
+		// A neighbour may be echoing a self-claim of ours that's fresher
+		// than what we locally remember (e.g. after we restarted); adopt
+		// its Seq into our own namespace so we never reuse a number we've
+		// already claimed.
+		if best.Seq > ts.selfSeq {
+			ts.selfSeq = best.Seq
+		}
+		ts.self = best
+		ts.haveParent = false
+		ts.coord = []uint64{}
+		ts.lastSeen = time.Now()
+		return
+	}
+
+	// Find the neighbour offering the shortest path to best.Root, applying
+	// hysteresis in favour of our current parent so we don't flap between
+	// near-equal paths.
+	var (
+		parent     PeerName
+		parentDist uint64
+		haveParent bool
+	)
+	for name, n := range ts.neighbours {
+		if n.Root != best.Root {
+			continue
+		}
+		if !haveParent || n.Distance < parentDist {
+			parent, parentDist, haveParent = name, n.Distance, true
+		}
+	}
+	if !haveParent {
+		// Nobody actually offers a path to the root we just picked; fall
+		// back to holding our own candidacy until something better shows up.
+		ts.self = self
+		ts.haveParent = false
+		ts.coord = []uint64{}
+		return
+	}
+	if ts.haveParent && parent != ts.parent {
+		if current, ok := ts.neighbours[ts.parent]; ok && current.Root == best.Root &&
+			current.Distance < parentDist+treeHysteresis {
+			parent, parentDist = ts.parent, current.Distance
+		}
+	}
+
+	if best.Root != ts.self.Root || best.Seq > ts.self.Seq {
+		ts.lastSeen = time.Now()
+	}
+	ts.self = RootAnnouncement{Root: best.Root, Seq: best.Seq, Distance: parentDist + 1}
+	ts.parent = parent
+	ts.haveParent = true
+	ts.coord = append(append([]uint64{}, ts.neighbours[parent].Coord...), ts.port(parent))
+}
+
+// port returns the port/link id assigned to reach neighbour name,
+// assigning the next one lazily on first use. Must be called with the
+// owning Routes' Lock held.
+func (ts *treeState) port(name PeerName) uint64 {
+	if port, found := ts.ports[name]; found {
+		return port
+	}
+	port := ts.nextPort
+	ts.nextPort++
+	ts.ports[name] = port
+	return port
+}
+
+// promoteSelf advances ts.selfSeq and makes it our current root claim, at
+// distance 0. Besides this, ts.selfSeq is only ever raised by recompute to
+// match a fresher echo of our own claim, so any self-candidacy recompute
+// later falls back to (see its use of ts.selfSeq) is guaranteed a Seq at
+// least as high as every earlier claim we've made for ourselves, however it
+// was arrived at.
+func (ts *treeState) promoteSelf(ourself PeerName) RootAnnouncement {
+	ts.selfSeq++
+	ts.self = RootAnnouncement{Root: ourself, Seq: ts.selfSeq}
+	return ts.self
+}
+
+// treeTick is invoked periodically to re-issue our root announcement, and
+// to promote ourselves to root if the incumbent has gone quiet for too
+// long.
+func (routes *Routes) treeTick() {
+	routes.Lock()
+	if routes.tree.self.Root != routes.ourself.Name && time.Since(routes.tree.lastSeen) > treeRootTimeout {
+		routes.tree.promoteSelf(routes.ourself.Name)
+		routes.tree.haveParent = false
+		routes.tree.coord = []uint64{}
+		routes.tree.lastSeen = time.Now()
+	} else if routes.tree.self.Root == routes.ourself.Name {
+		routes.tree.promoteSelf(routes.ourself.Name)
+	}
+	ann, coord, callback := routes.tree.self, routes.tree.coord, routes.tree.announce
+	routes.Unlock()
+	if callback != nil {
+		callback(ann, coord)
+	}
+}
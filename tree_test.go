@@ -0,0 +1,168 @@
+package mesh
+
+import (
+	"reflect"
+	"testing"
+)
+
+const (
+	testRootX = PeerName(1) // lower than testSelf, so it wins root election
+	testSelf  = PeerName(10)
+	testPeerA = PeerName(11)
+	testPeerB = PeerName(12)
+)
+
+func TestRecomputeNoNeighboursKeepsOwnCandidacy(t *testing.T) {
+	ts := newTreeState(testSelf)
+	ts.recompute(testSelf)
+
+	if ts.self.Root != testSelf || ts.haveParent || len(ts.coord) != 0 {
+		t.Fatalf("expected to remain our own root with no parent, got %+v haveParent=%v coord=%v", ts.self, ts.haveParent, ts.coord)
+	}
+}
+
+func TestRecomputeAdoptsLowerNamedRoot(t *testing.T) {
+	ts := newTreeState(testSelf)
+	ts.neighbours[testPeerA] = treeNeighbour{
+		RootAnnouncement: RootAnnouncement{Root: testRootX, Seq: 1, Distance: 0},
+		Coord:            []uint64{7},
+	}
+	ts.recompute(testSelf)
+
+	if ts.self.Root != testRootX || !ts.haveParent || ts.parent != testPeerA {
+		t.Fatalf("expected to adopt testRootX via testPeerA, got %+v parent=%v haveParent=%v", ts.self, ts.parent, ts.haveParent)
+	}
+	if want := []uint64{7, 0}; !reflect.DeepEqual(ts.coord, want) {
+		t.Fatalf("coord = %v, want %v", ts.coord, want)
+	}
+}
+
+// Regression test for the bug where losing every neighbour that offered a
+// path to an adopted root left us claiming a zero-distance path to that
+// root, rather than reverting to our own candidacy.
+func TestRecomputeFallsBackToOwnCandidacyWhenRootUnreachable(t *testing.T) {
+	ts := newTreeState(testSelf)
+	ts.neighbours[testPeerA] = treeNeighbour{
+		RootAnnouncement: RootAnnouncement{Root: testRootX, Seq: 1, Distance: 0},
+		Coord:            []uint64{7},
+	}
+	ts.recompute(testSelf)
+	if ts.self.Root != testRootX {
+		t.Fatalf("setup failed: expected to have adopted testRootX, got %+v", ts.self)
+	}
+
+	delete(ts.neighbours, testPeerA)
+	ts.recompute(testSelf)
+
+	if ts.self.Root != testSelf {
+		t.Fatalf("expected fallback to our own candidacy, still claiming root %v at distance %v", ts.self.Root, ts.self.Distance)
+	}
+	if ts.self.Distance != 0 {
+		t.Fatalf("expected distance 0 when falling back to our own candidacy, got %v", ts.self.Distance)
+	}
+	if ts.haveParent {
+		t.Fatalf("expected haveParent=false after losing the only path to the root")
+	}
+}
+
+func TestRecomputeHysteresisKeepsCurrentParentForSmallImprovement(t *testing.T) {
+	ts := newTreeState(testSelf)
+	ts.neighbours[testPeerA] = treeNeighbour{
+		RootAnnouncement: RootAnnouncement{Root: testRootX, Seq: 1, Distance: 5},
+		Coord:            []uint64{1},
+	}
+	ts.recompute(testSelf)
+	if ts.parent != testPeerA {
+		t.Fatalf("setup failed: expected parent testPeerA, got %v", ts.parent)
+	}
+
+	// testPeerB offers a path that's shorter, but by less than
+	// treeHysteresis, so we should stay with testPeerA.
+	ts.neighbours[testPeerB] = treeNeighbour{
+		RootAnnouncement: RootAnnouncement{Root: testRootX, Seq: 1, Distance: 5 - (treeHysteresis - 1)},
+		Coord:            []uint64{2},
+	}
+	ts.recompute(testSelf)
+
+	if ts.parent != testPeerA {
+		t.Fatalf("expected to keep parent testPeerA under hysteresis, switched to %v", ts.parent)
+	}
+}
+
+func TestRecomputeSwitchesParentWhenImprovementBeatsHysteresis(t *testing.T) {
+	ts := newTreeState(testSelf)
+	ts.neighbours[testPeerA] = treeNeighbour{
+		RootAnnouncement: RootAnnouncement{Root: testRootX, Seq: 1, Distance: 5},
+		Coord:            []uint64{1},
+	}
+	ts.recompute(testSelf)
+
+	ts.neighbours[testPeerB] = treeNeighbour{
+		RootAnnouncement: RootAnnouncement{Root: testRootX, Seq: 1, Distance: 5 - treeHysteresis},
+		Coord:            []uint64{2},
+	}
+	ts.recompute(testSelf)
+
+	if ts.parent != testPeerB {
+		t.Fatalf("expected to switch to the clearly-better parent testPeerB, still on %v", ts.parent)
+	}
+}
+
+// Regression test for the bug where the self-candidacy fallback reused
+// ts.self.Seq directly, which a foreign root's claim could have left
+// holding a stale, unrelated sequence number - so reclaiming our own root
+// candidacy could silently fail to supersede a peer's cached copy of an
+// earlier, higher-Seq claim we'd made for ourselves.
+func TestRecomputeFallbackPreservesSelfSeqAcrossForeignRootAdoption(t *testing.T) {
+	ts := newTreeState(testSelf)
+	for i := 0; i < 9; i++ {
+		ts.promoteSelf(testSelf)
+	}
+	if ts.selfSeq != 9 {
+		t.Fatalf("setup failed: expected selfSeq 9, got %d", ts.selfSeq)
+	}
+	cachedByPeer := RootAnnouncement{Root: testSelf, Seq: ts.selfSeq}
+
+	ts.neighbours[testPeerA] = treeNeighbour{
+		RootAnnouncement: RootAnnouncement{Root: testRootX, Seq: 1, Distance: 0},
+		Coord:            []uint64{7},
+	}
+	ts.recompute(testSelf)
+	if ts.self.Root != testRootX {
+		t.Fatalf("setup failed: expected to adopt testRootX, got %+v", ts.self)
+	}
+
+	delete(ts.neighbours, testPeerA)
+	ts.recompute(testSelf)
+	if ts.self.Root != testSelf {
+		t.Fatalf("expected fallback to our own candidacy, got %+v", ts.self)
+	}
+	if ts.self.Seq != 9 {
+		t.Fatalf("expected fallback self-claim to preserve our selfSeq high-water mark of 9, got Seq=%d", ts.self.Seq)
+	}
+
+	// The next periodic promotion (as treeTick issues) must produce an
+	// announcement that supersedes whatever a peer cached from before we
+	// lost our path to the foreign root.
+	reclaimed := ts.promoteSelf(testSelf)
+	if !reclaimed.supersedes(cachedByPeer) {
+		t.Fatalf("expected reclaimed root announcement %+v to supersede stale cached claim %+v", reclaimed, cachedByPeer)
+	}
+}
+
+func TestRootAnnouncementSupersedes(t *testing.T) {
+	lowerName := RootAnnouncement{Root: PeerName(1), Seq: 0}
+	higherName := RootAnnouncement{Root: PeerName(2), Seq: 100}
+	if !lowerName.supersedes(higherName) {
+		t.Fatalf("a lower peer name should always supersede a higher one regardless of sequence")
+	}
+
+	staleRoot := RootAnnouncement{Root: PeerName(1), Seq: 1}
+	freshRoot := RootAnnouncement{Root: PeerName(1), Seq: 2}
+	if !freshRoot.supersedes(staleRoot) {
+		t.Fatalf("a higher sequence number from the same root should supersede a stale one")
+	}
+	if staleRoot.supersedes(freshRoot) {
+		t.Fatalf("a stale sequence number must not supersede a fresher one")
+	}
+}
@@ -0,0 +1,135 @@
+package mesh
+
+// peerByName resolves name to the *Peer describing it, whether that's
+// ourself or a remote peer known to routes.peers. Must be called with
+// routes.peers (and, if name might be ourself, routes.ourself) read-locked.
+func (routes *Routes) peerByName(name PeerName) (*Peer, bool) {
+	if name == routes.ourself.Name {
+		return routes.ourself.Peer, true
+	}
+	peer, found := routes.peers.byName[name]
+	return peer, found
+}
+
+// buildAdjacency computes, for every peer reachable from root, the set of
+// its direct neighbours, calling the expensive Peer.Routes primitive
+// exactly once per peer: a peer X is a direct neighbour of P if and only if
+// X appears as its own next hop in P.Routes(nil, ...), since that's exactly
+// how Peer.Routes seeds the direct neighbours of its root. Sharing this
+// adjacency list across every source's BFS (see shortestDistances), rather
+// than rediscovering it from scratch per source, is what keeps
+// calculateAllShortestPaths from paying the Peer.Routes cost once per
+// direct neighbour on top of once for ourself. Must be called with
+// routes.peers and routes.ourself read-locked.
+func (routes *Routes) buildAdjacency(root *Peer, establishedAndSymmetric bool) map[PeerName][]PeerName {
+	adjacency := map[PeerName][]PeerName{}
+	frontier := []*Peer{root}
+	for len(frontier) > 0 {
+		var next []*Peer
+		for _, peer := range frontier {
+			if _, done := adjacency[peer.Name]; done {
+				continue
+			}
+			var neighbourNames []PeerName
+			_, nextHops := peer.Routes(nil, establishedAndSymmetric)
+			for otherName, hop := range nextHops {
+				if otherName == peer.Name || hop != otherName {
+					continue // hop != otherName means otherName isn't a direct neighbour of peer
+				}
+				neighbourNames = append(neighbourNames, otherName)
+			}
+			adjacency[peer.Name] = neighbourNames
+			for _, otherName := range neighbourNames {
+				if _, done := adjacency[otherName]; done {
+					continue
+				}
+				if other, found := routes.peerByName(otherName); found {
+					next = append(next, other)
+				}
+			}
+		}
+		frontier = next
+	}
+	return adjacency
+}
+
+// shortestDistances runs a breadth-first search over adjacency from source,
+// returning the hop-count distance to every peer it reaches. It has no
+// dependency on *Peer - pure graph logic over a plain adjacency list, kept
+// separate from buildAdjacency so it can be exercised directly in tests
+// against a synthetic graph.
+func shortestDistances(adjacency map[PeerName][]PeerName, source PeerName) map[PeerName]int {
+	dist := map[PeerName]int{source: 0}
+	frontier := []PeerName{source}
+	for len(frontier) > 0 {
+		var next []PeerName
+		for _, name := range frontier {
+			for _, other := range adjacency[name] {
+				if _, seen := dist[other]; seen {
+					continue
+				}
+				dist[other] = dist[name] + 1
+				next = append(next, other)
+			}
+		}
+		frontier = next
+	}
+	return dist
+}
+
+// nearShortestHops computes, for each destination in rootDist, which of
+// neighbours lies on a shortest (or, within slack, near-shortest) path from
+// root to that destination, capped at maxPaths. For each candidate
+// neighbour N it compares 1+neighbourDist[N][dst] against rootDist[dst]+
+// slack, so "near-equal" means the path via N is at most slack hops longer
+// than the true shortest path, exactly as UnicastPaths documents. Pure
+// logic over plain distance tables, kept separate from
+// calculateAllShortestPaths so it can be exercised directly in tests.
+func nearShortestHops(root PeerName, rootDist map[PeerName]int, neighbours []PeerName, neighbourDist map[PeerName]map[PeerName]int, maxPaths int, slack uint) unicastPathRoutes {
+	paths := unicastPathRoutes{root: {}}
+	for dst, d := range rootDist {
+		if dst == root {
+			continue
+		}
+		var hops []PeerName
+		for _, n := range neighbours {
+			dn, found := neighbourDist[n][dst]
+			if !found {
+				continue
+			}
+			if 1+dn <= d+int(slack) {
+				hops = append(hops, n)
+			}
+		}
+		if maxPaths > 0 && len(hops) > maxPaths {
+			hops = hops[:maxPaths]
+		}
+		paths[dst] = hops
+	}
+	return paths
+}
+
+// calculateAllShortestPaths computes, for each peer reachable from
+// ourself, every one of ourself's direct neighbours that lies on a
+// shortest (or, within slack, near-shortest) path to that peer, capped at
+// maxPaths. It builds the peer adjacency list once via buildAdjacency and
+// reuses it for every neighbour's BFS, rather than rediscovering it afresh
+// per neighbour, which would make the whole computation cubic in the
+// number of peers. Must be called with routes.peers and routes.ourself
+// read-locked.
+func (routes *Routes) calculateAllShortestPaths(establishedAndSymmetric bool, maxPaths int, slack uint) unicastPathRoutes {
+	root := routes.ourself.Peer
+	adjacency := routes.buildAdjacency(root, establishedAndSymmetric)
+	rootDist := shortestDistances(adjacency, root.Name)
+
+	var neighbours []PeerName
+	routes.ourself.ForEachConnectedPeer(establishedAndSymmetric, nil, func(peer *Peer) {
+		neighbours = append(neighbours, peer.Name)
+	})
+	neighbourDist := make(map[PeerName]map[PeerName]int, len(neighbours))
+	for _, n := range neighbours {
+		neighbourDist[n] = shortestDistances(adjacency, n)
+	}
+
+	return nearShortestHops(root.Name, rootDist, neighbours, neighbourDist, maxPaths, slack)
+}
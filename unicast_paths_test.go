@@ -0,0 +1,161 @@
+package mesh
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// chainAdjacency builds a straight-line graph 0 - 1 - 2 - ... - (n-1), as a
+// plain adjacency list so shortestDistances/nearShortestHops can be tested
+// without any *Peer/*Peers.
+func chainAdjacency(n int) map[PeerName][]PeerName {
+	adjacency := make(map[PeerName][]PeerName, n)
+	for i := 0; i < n; i++ {
+		var neighbours []PeerName
+		if i > 0 {
+			neighbours = append(neighbours, PeerName(i-1))
+		}
+		if i < n-1 {
+			neighbours = append(neighbours, PeerName(i+1))
+		}
+		adjacency[PeerName(i)] = neighbours
+	}
+	return adjacency
+}
+
+func TestShortestDistancesChain(t *testing.T) {
+	adjacency := chainAdjacency(5) // 0-1-2-3-4
+	dist := shortestDistances(adjacency, PeerName(0))
+
+	want := map[PeerName]int{0: 0, 1: 1, 2: 2, 3: 3, 4: 4}
+	if !reflect.DeepEqual(dist, want) {
+		t.Fatalf("shortestDistances = %v, want %v", dist, want)
+	}
+}
+
+func TestShortestDistancesUnreachableOmitted(t *testing.T) {
+	adjacency := map[PeerName][]PeerName{
+		0: {1},
+		1: {0},
+		2: {3},
+		3: {2},
+	}
+	dist := shortestDistances(adjacency, PeerName(0))
+	if _, found := dist[PeerName(2)]; found {
+		t.Fatalf("expected peer 2, in a disconnected component, to be absent from the distances, got %v", dist)
+	}
+	if _, found := dist[PeerName(3)]; found {
+		t.Fatalf("expected peer 3, in a disconnected component, to be absent from the distances, got %v", dist)
+	}
+}
+
+// A 3x3 grid gives each interior node two equal-cost shortest paths out,
+// exercising the equal-cost logic against more than a single chain.
+func gridAdjacency() map[PeerName][]PeerName {
+	// Layout (peer name = row*3+col):
+	// 0 1 2
+	// 3 4 5
+	// 6 7 8
+	adjacency := map[PeerName][]PeerName{}
+	add := func(a, b PeerName) {
+		adjacency[a] = append(adjacency[a], b)
+		adjacency[b] = append(adjacency[b], a)
+	}
+	add(0, 1)
+	add(1, 2)
+	add(3, 4)
+	add(4, 5)
+	add(6, 7)
+	add(7, 8)
+	add(0, 3)
+	add(3, 6)
+	add(1, 4)
+	add(4, 7)
+	add(2, 5)
+	add(5, 8)
+	return adjacency
+}
+
+func TestNearShortestHopsEqualCostPathsBothAdmitted(t *testing.T) {
+	adjacency := gridAdjacency()
+	root := PeerName(0)
+	rootDist := shortestDistances(adjacency, root)
+	neighbours := []PeerName{1, 3} // ourself's two direct neighbours
+	neighbourDist := map[PeerName]map[PeerName]int{
+		1: shortestDistances(adjacency, 1),
+		3: shortestDistances(adjacency, 3),
+	}
+
+	// Peer 8 (opposite corner) is reachable from both neighbours in
+	// exactly 3 hops - both are on a shortest path and should be admitted
+	// with zero slack.
+	paths := nearShortestHops(root, rootDist, neighbours, neighbourDist, 0, 0)
+	hops := paths[PeerName(8)]
+	sort.Slice(hops, func(i, j int) bool { return hops[i] < hops[j] })
+	if !reflect.DeepEqual(hops, []PeerName{1, 3}) {
+		t.Fatalf("hops to corner peer 8 = %v, want both equal-cost neighbours [1 3]", hops)
+	}
+}
+
+func TestNearShortestHopsChainZeroSlackAdmitsShortestPath(t *testing.T) {
+	adjacency := chainAdjacency(5) // 0-1-2-3-4; ourself is 0 with neighbour 1 only
+	root := PeerName(0)
+	rootDist := shortestDistances(adjacency, root)
+	neighbours := []PeerName{1}
+	neighbourDist := map[PeerName]map[PeerName]int{1: shortestDistances(adjacency, 1)}
+
+	// dist(0, 4) == 4. Via neighbour 1, 1+dist(1,4) == 1+3 == 4, so it's
+	// on the shortest path regardless of slack.
+	paths := nearShortestHops(root, rootDist, neighbours, neighbourDist, 0, 0)
+	if hops := paths[PeerName(4)]; !reflect.DeepEqual(hops, []PeerName{1}) {
+		t.Fatalf("hops to peer 4 with zero slack = %v, want [1]", hops)
+	}
+}
+
+func TestNearShortestHopsMaxPathsCap(t *testing.T) {
+	// A star: root 0 connects to four neighbours, each of which connects
+	// directly to the destination too, so all four are equal-cost paths.
+	adjacency := map[PeerName][]PeerName{
+		0: {1, 2, 3, 4},
+		1: {0, 9},
+		2: {0, 9},
+		3: {0, 9},
+		4: {0, 9},
+		9: {1, 2, 3, 4},
+	}
+	root := PeerName(0)
+	rootDist := shortestDistances(adjacency, root)
+	neighbours := []PeerName{1, 2, 3, 4}
+	neighbourDist := map[PeerName]map[PeerName]int{}
+	for _, n := range neighbours {
+		neighbourDist[n] = shortestDistances(adjacency, n)
+	}
+
+	paths := nearShortestHops(root, rootDist, neighbours, neighbourDist, 2, 0)
+	if got := len(paths[PeerName(9)]); got != 2 {
+		t.Fatalf("len(hops) to peer 9 with maxPaths=2 = %d, want 2", got)
+	}
+}
+
+func TestNearShortestHopsRootHasEmptyPath(t *testing.T) {
+	adjacency := chainAdjacency(3)
+	root := PeerName(0)
+	rootDist := shortestDistances(adjacency, root)
+	paths := nearShortestHops(root, rootDist, []PeerName{1}, map[PeerName]map[PeerName]int{1: shortestDistances(adjacency, 1)}, 0, 0)
+	if hops := paths[root]; len(hops) != 0 {
+		t.Fatalf("hops to root = %v, want an empty slice", hops)
+	}
+}
+
+// BenchmarkShortestDistancesChain guards against calculateAllShortestPaths'
+// BFS stage regressing back to super-linear behaviour: it should visit each
+// node/edge a constant number of times regardless of how many times it's
+// invoked (once per direct neighbour, in the real caller).
+func BenchmarkShortestDistancesChain(b *testing.B) {
+	adjacency := chainAdjacency(500)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		shortestDistances(adjacency, PeerName(0))
+	}
+}